@@ -0,0 +1,29 @@
+package master
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	subnetAllocationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "openshift_sdn",
+		Name:      "subnet_allocations_total",
+		Help:      "Total number of host subnet allocations, by cluster network CIDR.",
+	}, []string{"network"})
+
+	subnetReleasesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "openshift_sdn",
+		Name:      "subnet_releases_total",
+		Help:      "Total number of host subnet releases, by cluster network CIDR.",
+	}, []string{"network"})
+
+	subnetsFree = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "openshift_sdn",
+		Name:      "subnets_free",
+		Help:      "Number of host subnets that have not been allocated, by cluster network CIDR.",
+	}, []string{"network"})
+)
+
+func init() {
+	prometheus.MustRegister(subnetAllocationsTotal)
+	prometheus.MustRegister(subnetReleasesTotal)
+	prometheus.MustRegister(subnetsFree)
+}
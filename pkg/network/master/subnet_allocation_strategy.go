@@ -0,0 +1,198 @@
+package master
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// defaultCooldownPeriod is used by RandomWithCooldown when a ClusterNetwork
+// doesn't specify one.
+const defaultCooldownPeriod = 10 * time.Minute
+
+// cooldownSweepInterval is how often a RandomWithCooldown strategy checks
+// for entries that have served their cooldown and can rejoin the free set.
+const cooldownSweepInterval = 30 * time.Second
+
+// AllocationStrategy decides which free node a SubnetAllocator's buddy tree
+// hands out next, and what happens to a subnet when it's released. It's
+// configured per ClusterNetwork via NetworkInfo's
+// HostSubnetAllocationStrategy field, so operators can pick the tradeoff
+// that suits how downstream systems consume host subnet assignments.
+type AllocationStrategy interface {
+	// allocate finds a free ordinal at targetDepth (without marking it
+	// used -- the caller does that). Called with the owning
+	// SubnetAllocator's mutex held.
+	allocate(sna *SubnetAllocator, targetDepth uint32) (ordinal uint32, err error)
+	// release returns ordinal (at depth) toward the free set, or reports
+	// errSubnetAlreadyReleased if it's already been released (a strategy
+	// that defers actually freeing it in the buddy tree, e.g.
+	// RandomWithCooldown, must track this itself since the tree won't show
+	// it as free yet). Called with the owning SubnetAllocator's mutex held.
+	release(sna *SubnetAllocator, ordinal, depth uint32) error
+}
+
+// errSubnetAlreadyReleased is returned by an AllocationStrategy's release
+// when ordinal/depth has already been released and is pending reuse (e.g.
+// still on a RandomWithCooldown queue), so SubnetAllocator.Release can
+// reject a double release the same way it does for the other strategies.
+var errSubnetAlreadyReleased = fmt.Errorf("subnet is already released")
+
+// newAllocationStrategy builds the AllocationStrategy named by a
+// ClusterNetwork's HostSubnetAllocationStrategy field, defaulting to
+// SequentialFirstFit (the allocator's original next-fit behavior) for an
+// empty or unrecognized name.
+func newAllocationStrategy(name string) AllocationStrategy {
+	switch name {
+	case "LowestFreeIndex":
+		return NewLowestFreeIndex()
+	case "RandomWithCooldown":
+		return NewRandomWithCooldown(defaultCooldownPeriod)
+	default:
+		return NewSequentialFirstFit()
+	}
+}
+
+// SequentialFirstFit resumes searching from just after the last ordinal it
+// handed out, wrapping around, and releases subnets immediately. This is the
+// allocator's original next-fit behavior. It keeps a single position for all
+// depths: the last ordinal handed out at any depth is where the next search
+// starts, taken modulo the number of ordinals at the requested depth.
+type SequentialFirstFit struct {
+	next uint32
+}
+
+func NewSequentialFirstFit() *SequentialFirstFit {
+	return &SequentialFirstFit{}
+}
+
+func (s *SequentialFirstFit) allocate(sna *SubnetAllocator, targetDepth uint32) (uint32, error) {
+	ordinal, ok := sna.tree.findFreeFrom(s.next, targetDepth)
+	if !ok {
+		s.next = 0
+		return 0, ErrSubnetAllocatorFull
+	}
+	s.next = ordinal + 1
+	return ordinal, nil
+}
+
+func (s *SequentialFirstFit) release(sna *SubnetAllocator, ordinal, depth uint32) error {
+	sna.tree.release(sna.tree.indexAt(ordinal, depth))
+	return nil
+}
+
+// LowestFreeIndex always scans from ordinal 0, which makes allocation
+// deterministic regardless of allocation/release history. It's mainly
+// useful for tests that assert on exact subnet assignment.
+type LowestFreeIndex struct{}
+
+func NewLowestFreeIndex() *LowestFreeIndex { return &LowestFreeIndex{} }
+
+func (LowestFreeIndex) allocate(sna *SubnetAllocator, targetDepth uint32) (uint32, error) {
+	ordinal, ok := sna.tree.findFreeFrom(0, targetDepth)
+	if !ok {
+		return 0, ErrSubnetAllocatorFull
+	}
+	return ordinal, nil
+}
+
+func (LowestFreeIndex) release(sna *SubnetAllocator, ordinal, depth uint32) error {
+	sna.tree.release(sna.tree.indexAt(ordinal, depth))
+	return nil
+}
+
+// cooldownEntry is one released-but-not-yet-reusable subnet tracked by
+// RandomWithCooldown.
+type cooldownEntry struct {
+	ordinal, depth uint32
+	releasedAt     time.Time
+}
+
+// RandomWithCooldown picks uniformly at random among subnets that are free
+// and not in cooldown, and places released subnets on a time-ordered FIFO
+// cooldown queue instead of freeing them immediately. This avoids a churny
+// node pool causing rapid subnet reuse while downstream systems (route
+// reflectors, monitoring) still have the old subnet-to-node mapping
+// cached. If every subnet is either allocated or on cooldown, allocate
+// falls back to reclaiming the oldest cooldown entry rather than failing.
+type RandomWithCooldown struct {
+	cooldown time.Duration
+
+	mutex sync.Mutex
+	queue []cooldownEntry
+	// queued tracks which (depth, ordinal) pairs are currently on queue, so
+	// release can reject a double release the tree itself can't detect --
+	// a queued entry's tree node is still stateUsed, not stateFree.
+	queued map[cooldownKey]bool
+}
+
+// cooldownKey identifies one (depth, ordinal) pair in queued.
+type cooldownKey struct {
+	depth, ordinal uint32
+}
+
+func NewRandomWithCooldown(cooldown time.Duration) *RandomWithCooldown {
+	return &RandomWithCooldown{cooldown: cooldown, queued: make(map[cooldownKey]bool)}
+}
+
+func (r *RandomWithCooldown) allocate(sna *SubnetAllocator, targetDepth uint32) (uint32, error) {
+	if free := sna.tree.freeOrdinals(targetDepth); len(free) > 0 {
+		return free[rand.Intn(len(free))], nil
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i, entry := range r.queue {
+		if entry.depth != targetDepth {
+			continue
+		}
+		r.queue = append(r.queue[:i:i], r.queue[i+1:]...)
+		delete(r.queued, cooldownKey{depth: entry.depth, ordinal: entry.ordinal})
+		return entry.ordinal, nil
+	}
+	return 0, ErrSubnetAllocatorFull
+}
+
+func (r *RandomWithCooldown) release(sna *SubnetAllocator, ordinal, depth uint32) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	key := cooldownKey{depth: depth, ordinal: ordinal}
+	if r.queued[key] {
+		return errSubnetAlreadyReleased
+	}
+	r.queued[key] = true
+	r.queue = append(r.queue, cooldownEntry{ordinal: ordinal, depth: depth, releasedAt: time.Now()})
+	return nil
+}
+
+// sweep returns any cooled-down entries to sna's buddy tree. It's called
+// periodically by a background goroutine started alongside the
+// SubnetAllocator, since unlike the other strategies, RandomWithCooldown
+// doesn't free a released subnet as part of release() itself.
+func (r *RandomWithCooldown) sweep(sna *SubnetAllocator) {
+	r.mutex.Lock()
+	i := 0
+	for ; i < len(r.queue); i++ {
+		if time.Since(r.queue[i].releasedAt) < r.cooldown {
+			break
+		}
+	}
+	ready := append([]cooldownEntry(nil), r.queue[:i]...)
+	r.queue = r.queue[i:]
+	for _, entry := range ready {
+		delete(r.queued, cooldownKey{depth: entry.depth, ordinal: entry.ordinal})
+	}
+	r.mutex.Unlock()
+
+	if len(ready) == 0 {
+		return
+	}
+
+	sna.mutex.Lock()
+	defer sna.mutex.Unlock()
+	for _, entry := range ready {
+		sna.tree.release(sna.tree.indexAt(entry.ordinal, entry.depth))
+	}
+	sna.persist()
+}
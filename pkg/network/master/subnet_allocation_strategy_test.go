@@ -0,0 +1,92 @@
+package master
+
+import (
+	"net"
+	"testing"
+)
+
+// newTestRandomWithCooldownAllocator builds a SubnetAllocator over a small
+// IPv4 network (4 host subnets) with a RandomWithCooldown strategy whose
+// cooldown is zero, so sweep reclaims a released subnet on the very next
+// call instead of needing a fake clock.
+func newTestRandomWithCooldownAllocator(t *testing.T) (*SubnetAllocator, *RandomWithCooldown) {
+	t.Helper()
+	sa, err := newSubnetAllocator("10.1.0.0/24", 6, "", nil)
+	if err != nil {
+		t.Fatalf("newSubnetAllocator: %v", err)
+	}
+	strategy := NewRandomWithCooldown(0)
+	sa.strategy = strategy
+	return sa, strategy
+}
+
+func TestRandomWithCooldownRejectsDoubleRelease(t *testing.T) {
+	sa, _ := newTestRandomWithCooldownAllocator(t)
+
+	subnet, err := sa.Allocate()
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	if err := sa.Release(subnet); err != nil {
+		t.Fatalf("first Release: %v", err)
+	}
+	if err := sa.Release(subnet); err == nil {
+		t.Fatal("second Release of a subnet still on the cooldown queue succeeded, want an error")
+	}
+}
+
+func TestRandomWithCooldownSweepReturnsSubnetToFreeSet(t *testing.T) {
+	sa, strategy := newTestRandomWithCooldownAllocator(t)
+
+	subnet, err := sa.Allocate()
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	if err := sa.Release(subnet); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	// Still on the cooldown queue: the buddy tree hasn't been told it's
+	// free yet, so Free() doesn't count it.
+	if got, want := sa.Free(), uint32(3); got != want {
+		t.Fatalf("Free() before sweep = %d, want %d", got, want)
+	}
+
+	strategy.sweep(sa)
+
+	if got, want := sa.Free(), uint32(4); got != want {
+		t.Fatalf("Free() after sweep = %d, want %d", got, want)
+	}
+	if err := sa.AllocateSpecific(subnet); err != nil {
+		t.Fatalf("expected %v to be allocatable again after sweep, got %v", subnet, err)
+	}
+}
+
+func TestRandomWithCooldownAllocateFallsBackToOldestQueuedEntryWhenFull(t *testing.T) {
+	sa, _ := newTestRandomWithCooldownAllocator(t)
+
+	var allocated []*net.IPNet
+	for i := 0; i < 4; i++ {
+		subnet, err := sa.Allocate()
+		if err != nil {
+			t.Fatalf("Allocate %d: %v", i, err)
+		}
+		allocated = append(allocated, subnet)
+	}
+
+	// Release one without sweeping: the tree still thinks it's used, so a
+	// subsequent Allocate has nothing free in the tree and must fall back
+	// to reclaiming the queued entry instead of returning
+	// ErrSubnetAllocatorFull.
+	if err := sa.Release(allocated[0]); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	reclaimed, err := sa.Allocate()
+	if err != nil {
+		t.Fatalf("Allocate after releasing into cooldown with no other free subnets: %v", err)
+	}
+	if reclaimed.String() != allocated[0].String() {
+		t.Fatalf("Allocate reclaimed %v, want the queued %v", reclaimed, allocated[0])
+	}
+}
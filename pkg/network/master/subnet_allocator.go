@@ -3,141 +3,394 @@ package master
 import (
 	"encoding/binary"
 	"fmt"
+	"math/big"
 	"net"
 	"sync"
+	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
 )
 
 var ErrSubnetAllocatorFull = fmt.Errorf("No subnets available.")
 
+// maxSubnetBits bounds how many subnet-index bits any allocator may have,
+// IPv4 or IPv6, so that a single ClusterNetwork never requires more than
+// 64K host subnets to be tracked in memory, and so newBuddyTree's
+// uint32(2)<<depth sizing can't overflow (it would for depth >= 31, which
+// an IPv4 /0 with hostBits=1 reaches otherwise).
+const maxSubnetBits = 16
+
+// SubnetAllocator carves host subnets of one or more sizes out of a single
+// cluster CIDR. hostBits is the narrowest (and most common) host subnet
+// size it hands out; AllocateWithHostBits can also be asked for any wider
+// subnet, down to the whole cluster CIDR, via the same buddy tree.
 type SubnetAllocator struct {
 	network    *net.IPNet
 	hostBits   uint32
-	leftShift  uint32
-	leftMask   uint32
-	rightShift uint32
-	rightMask  uint32
-	next       uint32
-	allocMap   map[string]bool
+	subnetBits uint32 // tree depth: numSubnetBits at the narrowest (hostBits) granularity
+	tree       *buddyTree
+	strategy   AllocationStrategy
+	store      subnetAllocatorStore
 	mutex      sync.Mutex
 }
 
-func newSubnetAllocator(network string, hostBits uint32) (*SubnetAllocator, error) {
+func newSubnetAllocator(network string, hostBits uint32, strategyName string, store subnetAllocatorStore) (*SubnetAllocator, error) {
 	_, netIP, err := net.ParseCIDR(network)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse network address: %q", network)
 	}
 
-	netMaskSize, _ := netIP.Mask.Size()
+	netMaskSize, totalBits := netIP.Mask.Size()
 	if hostBits == 0 {
 		return nil, fmt.Errorf("host capacity cannot be zero.")
-	} else if hostBits > (32 - uint32(netMaskSize)) {
+	} else if hostBits > uint32(totalBits-netMaskSize) {
 		return nil, fmt.Errorf("subnet capacity cannot be larger than number of networks available.")
 	}
-	subnetBits := 32 - uint32(netMaskSize) - hostBits
-
-	// In the simple case, the subnet part of the 32-bit IP address is just the subnet
-	// number shifted hostBits to the left. However, if hostBits isn't a multiple of
-	// 8, then it can be difficult to distinguish the subnet part and the host part
-	// visually. (Eg, given network="10.1.0.0/16" and hostBits=6, then "10.1.0.50" and
-	// "10.1.0.70" are on different networks.)
-	//
-	// To try to avoid this confusion, if the subnet extends into the next higher
-	// octet, we rotate the bits of the subnet number so that we use the subnets with
-	// all 0s in the shared octet first. So again given network="10.1.0.0/16",
-	// hostBits=6, we first allocate 10.1.0.0/26, 10.1.1.0/26, etc, through
-	// 10.1.255.0/26 (just like we would with /24s in the hostBits=8 case), and only
-	// if we use up all of those subnets do we start allocating 10.1.0.64/26,
-	// 10.1.1.64/26, etc.
-	var leftShift, rightShift uint32
-	var leftMask, rightMask uint32
-	if hostBits%8 != 0 && ((hostBits-1)/8 != (hostBits+subnetBits-1)/8) {
-		leftShift = 8 - (hostBits % 8)
-		leftMask = uint32(1)<<(32-uint32(netMaskSize)) - 1
-		rightShift = subnetBits - leftShift
-		rightMask = (uint32(1)<<leftShift - 1) << hostBits
-	} else {
-		leftShift = 0
-		leftMask = 0xFFFFFFFF
-		rightShift = 0
-		rightMask = 0
+	subnetBits := uint32(totalBits-netMaskSize) - hostBits
+	if subnetBits > maxSubnetBits {
+		return nil, fmt.Errorf("network %q with host bits %d would require 2^%d host subnets, which exceeds the allocator limit of 2^%d", network, hostBits, subnetBits, maxSubnetBits)
 	}
 
-	return &SubnetAllocator{
+	sna := &SubnetAllocator{
 		network:    netIP,
 		hostBits:   hostBits,
-		leftShift:  leftShift,
-		leftMask:   leftMask,
-		rightShift: rightShift,
-		rightMask:  rightMask,
-		next:       0,
-		allocMap:   make(map[string]bool),
-	}, nil
+		subnetBits: subnetBits,
+		tree:       newBuddyTree(subnetBits),
+		strategy:   newAllocationStrategy(strategyName),
+		store:      store,
+	}
+
+	if store != nil {
+		words, generation, err := store.Load(netIP.String())
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("failed to load persisted subnet allocator state for %s, starting from an empty allocator: %v", netIP.String(), err))
+		} else if words != nil {
+			sna.tree.loadWords(words)
+			sna.tree.generation = generation
+		}
+	}
+
+	if sweeper, ok := sna.strategy.(periodicSweeper); ok {
+		go sna.runSweeper(sweeper)
+	}
+
+	return sna, nil
+}
+
+// periodicSweeper is implemented by an AllocationStrategy that needs
+// background maintenance beyond what allocate/release do inline, e.g.
+// RandomWithCooldown reclaiming entries whose cooldown has elapsed.
+type periodicSweeper interface {
+	sweep(sna *SubnetAllocator)
+}
+
+// runSweeper calls sweeper.sweep on a fixed interval for the lifetime of
+// sna. It never returns, since a SubnetAllocator lives for the lifetime of
+// the master.
+func (sna *SubnetAllocator) runSweeper(sweeper periodicSweeper) {
+	ticker := time.NewTicker(cooldownSweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		sweeper.sweep(sna)
+	}
+}
+
+// bigLsh returns big.NewInt(n) << shift. It exists only to keep the mask
+// arithmetic below readable.
+func bigLsh(n int64, shift uint32) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(n), uint(shift))
 }
 
-func (sna *SubnetAllocator) markAllocatedNetwork(ipNet *net.IPNet) error {
+// rotationParams computes the bit-rotation masks used to order subnet
+// ordinals so that, when hostBits isn't a multiple of 8, subnets with all
+// 0s in the octet they share with the host part are allocated first. See
+// subnetAddress for how they're used. totalBits/netMaskSize describe the
+// cluster CIDR; hostBits/subnetBits describe the granularity being
+// addressed (which, for AllocateWithHostBits, may be coarser than the
+// allocator's own hostBits).
+func rotationParams(totalBits, netMaskSize int, hostBits, subnetBits uint32) (leftShift uint32, leftMask *big.Int, rightShift uint32, rightMask *big.Int) {
+	if hostBits%8 != 0 && subnetBits > 0 && ((hostBits-1)/8 != (hostBits+subnetBits-1)/8) {
+		leftShift = 8 - (hostBits % 8)
+		leftMask = bigLsh(1, uint32(totalBits-netMaskSize))
+		leftMask.Sub(leftMask, big.NewInt(1))
+		rightShift = subnetBits - leftShift
+		rightMask = bigLsh(1, leftShift)
+		rightMask.Sub(rightMask, big.NewInt(1))
+		rightMask.Lsh(rightMask, uint(hostBits))
+		return
+	}
+	leftShift = 0
+	leftMask = bigLsh(1, uint32(totalBits-netMaskSize))
+	leftMask.Sub(leftMask, big.NewInt(1))
+	rightShift = 0
+	rightMask = big.NewInt(0)
+	return
+}
+
+// MarkAllocated records ipNet as allocated. It is a no-op if ipNet is
+// already marked allocated.
+func (sna *SubnetAllocator) MarkAllocated(ipNet *net.IPNet) error {
 	sna.mutex.Lock()
 	defer sna.mutex.Unlock()
 
 	if !sna.network.Contains(ipNet.IP) {
 		return fmt.Errorf("provided subnet doesn't belong to network: %v", ipNet)
 	}
-	if !sna.allocMap[ipNet.String()] {
-		sna.allocMap[ipNet.String()] = true
+	idx, _, err := sna.nodeForSubnet(ipNet)
+	if err != nil {
+		return err
+	}
+	switch sna.tree.states[idx] {
+	case stateUsed:
+		return nil
+	case stateFree:
+		sna.tree.markUsed(idx)
+		sna.persist()
+		return nil
+	default:
+		return fmt.Errorf("subnet %v partially overlaps other allocated subnets", ipNet)
 	}
-	return nil
 }
 
-func (sna *SubnetAllocator) allocateNetwork() (*net.IPNet, error) {
-	var (
-		numSubnets    uint32
-		numSubnetBits uint32
-	)
+// Allocate returns the next free host subnet of the allocator's configured
+// (narrowest) size.
+func (sna *SubnetAllocator) Allocate() (*net.IPNet, error) {
+	return sna.AllocateWithHostBits(sna.hostBits)
+}
+
+// AllocateWithHostBits returns the next free host subnet with the given
+// number of host bits, which must be between the allocator's configured
+// hostBits and the whole cluster CIDR.
+func (sna *SubnetAllocator) AllocateWithHostBits(hostBits uint32) (*net.IPNet, error) {
 	sna.mutex.Lock()
 	defer sna.mutex.Unlock()
 
-	baseipu := IPToUint32(sna.network.IP)
-	netMaskSize, _ := sna.network.Mask.Size()
-	numSubnetBits = 32 - uint32(netMaskSize) - sna.hostBits
-	numSubnets = 1 << numSubnetBits
-
-	var i uint32
-	for i = 0; i < numSubnets; i++ {
-		n := (i + sna.next) % numSubnets
-		shifted := n << sna.hostBits
-		ipu := baseipu | ((shifted << sna.leftShift) & sna.leftMask) | ((shifted >> sna.rightShift) & sna.rightMask)
-		genIp := Uint32ToIP(ipu)
-		genSubnet := &net.IPNet{IP: genIp, Mask: net.CIDRMask(int(numSubnetBits)+netMaskSize, 32)}
-		if !sna.allocMap[genSubnet.String()] {
-			sna.allocMap[genSubnet.String()] = true
-			sna.next = n + 1
-			return genSubnet, nil
-		}
+	d, err := sna.depthForHostBits(hostBits)
+	if err != nil {
+		return nil, err
 	}
 
-	sna.next = 0
-	return nil, ErrSubnetAllocatorFull
+	ordinal, err := sna.strategy.allocate(sna, d)
+	if err != nil {
+		return nil, err
+	}
+	sna.tree.markUsed(sna.tree.indexAt(ordinal, d))
+	sna.persist()
+
+	subnet := sna.subnetAt(ordinal, d)
+	subnetAllocationsTotal.WithLabelValues(sna.network.String()).Inc()
+	subnetsFree.WithLabelValues(sna.network.String()).Set(float64(sna.tree.freeLeaves(1, 0)))
+	return subnet, nil
 }
 
-func (sna *SubnetAllocator) releaseNetwork(ipnet *net.IPNet) error {
+// errSubnetAlreadyAllocated is AllocateSpecific's internal collision signal;
+// callers see it wrapped as ErrPreferredSubnetTaken.
+var errSubnetAlreadyAllocated = fmt.Errorf("subnet is already allocated")
+
+// AllocateSpecific allocates exactly ipNet, failing with
+// errSubnetAlreadyAllocated if it, anything underneath it in the buddy
+// tree, or a wider subnet containing it is already taken. It's used to
+// honor a caller-preferred subnet, and
+// to reserve a subnet ahead of a HostSubnet actually appearing.
+func (sna *SubnetAllocator) AllocateSpecific(ipNet *net.IPNet) error {
 	sna.mutex.Lock()
 	defer sna.mutex.Unlock()
 
-	if !sna.network.Contains(ipnet.IP) {
-		return fmt.Errorf("provided subnet %v doesn't belong to the network %v.", ipnet, sna.network)
+	if !sna.network.Contains(ipNet.IP) {
+		return fmt.Errorf("provided subnet doesn't belong to network: %v", ipNet)
+	}
+	idx, _, err := sna.nodeForSubnet(ipNet)
+	if err != nil {
+		return err
 	}
+	if !sna.tree.isAvailable(idx) {
+		return errSubnetAlreadyAllocated
+	}
+	sna.tree.markUsed(idx)
+	sna.persist()
+
+	subnetAllocationsTotal.WithLabelValues(sna.network.String()).Inc()
+	subnetsFree.WithLabelValues(sna.network.String()).Set(float64(sna.tree.freeLeaves(1, 0)))
+	return nil
+}
 
-	ipnetStr := ipnet.String()
-	if !sna.allocMap[ipnetStr] {
-		return fmt.Errorf("provided subnet %v is already available.", ipnet)
-	} else {
-		sna.allocMap[ipnetStr] = false
+// Release returns ipNet to the free set.
+func (sna *SubnetAllocator) Release(ipNet *net.IPNet) error {
+	sna.mutex.Lock()
+	defer sna.mutex.Unlock()
+
+	if !sna.network.Contains(ipNet.IP) {
+		return fmt.Errorf("provided subnet %v doesn't belong to the network %v.", ipNet, sna.network)
+	}
+	idx, depth, err := sna.nodeForSubnet(ipNet)
+	if err != nil {
+		return err
+	}
+	if sna.tree.states[idx] != stateUsed {
+		return fmt.Errorf("provided subnet %v is already available.", ipNet)
 	}
+	if err := sna.strategy.release(sna, idx-(uint32(1)<<depth), depth); err != nil {
+		return fmt.Errorf("provided subnet %v is already available.", ipNet)
+	}
+	sna.persist()
+
+	subnetReleasesTotal.WithLabelValues(sna.network.String()).Inc()
+	subnetsFree.WithLabelValues(sna.network.String()).Set(float64(sna.tree.freeLeaves(1, 0)))
 	return nil
 }
 
+// Free returns the number of hostBits-sized subnets that have not been
+// allocated.
+func (sna *SubnetAllocator) Free() uint32 {
+	sna.mutex.Lock()
+	defer sna.mutex.Unlock()
+	return sna.tree.freeLeaves(1, 0)
+}
+
+// Capacity returns the total number of hostBits-sized host subnets network
+// can hold.
+func (sna *SubnetAllocator) Capacity() uint32 {
+	return uint32(1) << sna.subnetBits
+}
+
+func (sna *SubnetAllocator) persist() {
+	if sna.store == nil {
+		return
+	}
+	if err := sna.store.Save(sna.network.String(), sna.tree.toWords(), sna.tree.generation); err != nil {
+		utilruntime.HandleError(fmt.Errorf("failed to persist subnet allocator state for %s: %v", sna.network.String(), err))
+	}
+}
+
+// allocatedSubnetsNotIn returns the CIDR strings of every subnet this
+// allocator's tree has marked allocated but which has no entry in live.
+func (sna *SubnetAllocator) allocatedSubnetsNotIn(live sets.String) []string {
+	sna.mutex.Lock()
+	defer sna.mutex.Unlock()
+
+	var leaked []string
+	var walk func(idx, d uint32)
+	walk = func(idx, d uint32) {
+		switch sna.tree.states[idx] {
+		case stateFree:
+			return
+		case stateUsed:
+			if subnet := sna.subnetAt(idx-(uint32(1)<<d), d).String(); !live.Has(subnet) {
+				leaked = append(leaked, subnet)
+			}
+		default: // partial: some of this subtree is allocated, recurse to find it
+			walk(2*idx, d+1)
+			walk(2*idx+1, d+1)
+		}
+	}
+	walk(1, 0)
+	return leaked
+}
+
+// depthForHostBits converts a requested host-subnet size into a buddy tree
+// depth (0 = the whole cluster CIDR, subnetBits = narrowest).
+func (sna *SubnetAllocator) depthForHostBits(hostBits uint32) (uint32, error) {
+	if hostBits < sna.hostBits {
+		return 0, fmt.Errorf("requested host bits %d is narrower than the %d bits configured for network %s", hostBits, sna.hostBits, sna.network)
+	}
+	netMaskSize, totalBits := sna.network.Mask.Size()
+	maxHostBits := uint32(totalBits - netMaskSize)
+	if hostBits > maxHostBits {
+		return 0, fmt.Errorf("requested host bits %d is wider than network %s can hold", hostBits, sna.network)
+	}
+	return maxHostBits - hostBits, nil
+}
+
+// nodeForSubnet returns ipNet's buddy tree index and depth, failing if
+// ipNet isn't a valid subnet of network at a depth the tree tracks.
+func (sna *SubnetAllocator) nodeForSubnet(ipNet *net.IPNet) (idx, depth uint32, err error) {
+	netMaskSize, totalBits := sna.network.Mask.Size()
+	ones, bits := ipNet.Mask.Size()
+	if bits != totalBits || ones < netMaskSize {
+		return 0, 0, fmt.Errorf("%v is not a valid host subnet of network %v", ipNet, sna.network)
+	}
+	d := uint32(ones - netMaskSize)
+	if d > sna.subnetBits {
+		return 0, 0, fmt.Errorf("%v is narrower than any host subnet network %v can allocate", ipNet, sna.network)
+	}
+	n := ordinalAt(sna.network, ipNet, d)
+	return (uint32(1) << d) + n, d, nil
+}
+
+// subnetAt computes the *net.IPNet for subnet ordinal n at buddy tree
+// depth d.
+func (sna *SubnetAllocator) subnetAt(n, d uint32) *net.IPNet {
+	netMaskSize, totalBits := sna.network.Mask.Size()
+	ip := subnetAddress(sna.network, n, d)
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(netMaskSize+int(d), totalBits)}
+}
+
+// subnetAddress computes the address for subnet ordinal n at depth d
+// within network, applying the same "rotate so all-zero-in-shared-octet
+// subnets come first" trick the original fixed-size allocator used.
+func subnetAddress(network *net.IPNet, n uint32, d uint32) net.IP {
+	netMaskSize, totalBits := network.Mask.Size()
+	hostBitsPrime := uint32(totalBits-netMaskSize) - d
+	leftShift, leftMask, rightShift, rightMask := rotationParams(totalBits, netMaskSize, hostBitsPrime, d)
+
+	baseip := ipToBigInt(network.IP)
+	shifted := new(big.Int).Lsh(big.NewInt(int64(n)), uint(hostBitsPrime))
+	left := new(big.Int).And(new(big.Int).Lsh(shifted, uint(leftShift)), leftMask)
+	right := new(big.Int).And(new(big.Int).Rsh(shifted, uint(rightShift)), rightMask)
+	ipInt := new(big.Int).Or(baseip, new(big.Int).Or(left, right))
+	return bigIntToIP(ipInt, totalBits == net.IPv6len*8)
+}
+
+// ordinalAt is the inverse of subnetAddress: it recovers the subnet
+// ordinal at depth d that the rotation in subnetAddress would have
+// produced for ipNet.
+func ordinalAt(network *net.IPNet, ipNet *net.IPNet, d uint32) uint32 {
+	netMaskSize, totalBits := network.Mask.Size()
+	hostBitsPrime := uint32(totalBits-netMaskSize) - d
+	leftShift, leftMask, rightShift, rightMask := rotationParams(totalBits, netMaskSize, hostBitsPrime, d)
+
+	offset := new(big.Int).Xor(ipToBigInt(ipNet.IP), ipToBigInt(network.IP))
+	left := new(big.Int).And(offset, leftMask)
+	right := new(big.Int).And(offset, rightMask)
+	shifted := new(big.Int).Or(new(big.Int).Rsh(left, uint(leftShift)), new(big.Int).Lsh(right, uint(rightShift)))
+	return uint32(new(big.Int).Rsh(shifted, uint(hostBitsPrime)).Uint64())
+}
+
+func ipFamily(ip net.IP) int {
+	if ip.To4() != nil {
+		return 4
+	}
+	return 6
+}
+
+func ipToBigInt(ip net.IP) *big.Int {
+	if ip4 := ip.To4(); ip4 != nil {
+		return new(big.Int).SetBytes(ip4)
+	}
+	return new(big.Int).SetBytes(ip.To16())
+}
+
+// bigIntToIP is the inverse of ipToBigInt; v6 indicates which of the two
+// representations to produce.
+func bigIntToIP(i *big.Int, v6 bool) net.IP {
+	width := net.IPv4len
+	if v6 {
+		width = net.IPv6len
+	}
+	buf := make([]byte, width)
+	b := i.Bytes()
+	copy(buf[width-len(b):], b)
+	if v6 {
+		return net.IP(buf)
+	}
+	return net.IPv4(buf[0], buf[1], buf[2], buf[3])
+}
+
+// IPToUint32 and Uint32ToIP are retained for IPv4-only callers elsewhere in
+// the SDN master (e.g. egress IP allocation) that have no need for the
+// dual-stack arithmetic above.
 func IPToUint32(ip net.IP) uint32 {
 	return binary.BigEndian.Uint32(ip.To4())
 }
@@ -152,7 +405,7 @@ func Uint32ToIP(u uint32) net.IP {
 
 func (master *OsdnMaster) initSubnetAllocators() error {
 	for _, cn := range master.networkInfo.ClusterNetworks {
-		sa, err := newSubnetAllocator(cn.ClusterCIDR.String(), cn.HostSubnetLength)
+		sa, err := newSubnetAllocator(cn.ClusterCIDR.String(), cn.HostSubnetLength, cn.HostSubnetAllocationStrategy, master.subnetAllocatorStore)
 		if err != nil {
 			return err
 		}
@@ -160,17 +413,30 @@ func (master *OsdnMaster) initSubnetAllocators() error {
 		master.subnetAllocatorMap[cn] = sa
 	}
 
-	// Populate subnet allocator
 	subnets, err := master.networkClient.NetworkV1().HostSubnets().List(metav1.ListOptions{})
 	if err != nil {
 		return err
 	}
+	live := sets.NewString()
 	for _, sn := range subnets.Items {
+		live.Insert(sn.Subnet)
+		// The persisted tree should already have this marked allocated;
+		// MarkAllocated only does real work here to repair drift, e.g. a
+		// HostSubnet created after the last successful persist.
 		if err := master.markAllocatedNetwork(sn.Subnet); err != nil {
 			utilruntime.HandleError(err)
 		}
 	}
 
+	// Conversely, a subnet the persisted tree thinks is allocated but which
+	// no longer has a matching HostSubnet indicates a release that never
+	// made it to disk, or a HostSubnet deleted some other way.
+	for _, sa := range master.subnetAllocatorList {
+		for _, leaked := range sa.allocatedSubnetsNotIn(live) {
+			utilruntime.HandleError(fmt.Errorf("subnet allocator for %s has %s marked allocated from persisted state, but no matching HostSubnet exists", sa.network.String(), leaked))
+		}
+	}
+
 	return nil
 }
 
@@ -179,29 +445,132 @@ func (master *OsdnMaster) markAllocatedNetwork(subnet string) error {
 	if err != nil {
 		return err
 	}
-	if err = sa.markAllocatedNetwork(ipnet); err != nil {
+	if err = sa.MarkAllocated(ipnet); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (master *OsdnMaster) allocateNetwork(nodeName string) (string, error) {
-	var sn *net.IPNet
-	var err error
+// ErrPreferredSubnetTaken is returned by allocateNetwork when the caller's
+// preferred subnet (e.g. from the node's
+// network.openshift.io/preferred-subnet annotation) is already allocated to
+// someone else, so the caller can decide whether to fall back to normal
+// allocation or fail outright.
+type ErrPreferredSubnetTaken struct {
+	Subnet string
+}
+
+func (e *ErrPreferredSubnetTaken) Error() string {
+	return fmt.Sprintf("preferred subnet %s is already allocated", e.Subnet)
+}
+
+// allocateNetwork allocates one host subnet per address family configured
+// in the cluster networks (i.e. one IPv4 and, for a dual-stack cluster, one
+// IPv6 subnet), returning their CIDRs so the caller can persist all of them
+// onto the node's HostSubnet. If preferred is non-nil, it is allocated (for
+// its address family only) in place of the normal choice; on collision
+// this returns *ErrPreferredSubnetTaken instead of falling back, so the
+// caller can decide whether a fallback allocation is acceptable. If
+// requestedHostBits is non-zero, it overrides the per-node subnet size
+// (for address families not already satisfied by preferred) instead of
+// using each allocator's configured default.
+func (master *OsdnMaster) allocateNetwork(nodeName string, preferred *net.IPNet, requestedHostBits uint32) ([]string, error) {
+	allocatedByFamily := make(map[int]bool)
+	var allocated []string
+
+	if preferred != nil {
+		subnet, err := master.allocatePreferredNetwork(preferred)
+		if err != nil {
+			return nil, err
+		}
+		allocated = append(allocated, subnet)
+		allocatedByFamily[ipFamily(preferred.IP)] = true
+	}
 
 	for _, possibleSubnet := range master.subnetAllocatorList {
-		sn, err = possibleSubnet.allocateNetwork()
+		family := ipFamily(possibleSubnet.network.IP)
+		if allocatedByFamily[family] {
+			continue
+		}
+
+		var sn *net.IPNet
+		var err error
+		if requestedHostBits != 0 {
+			sn, err = possibleSubnet.AllocateWithHostBits(requestedHostBits)
+		} else {
+			sn, err = possibleSubnet.Allocate()
+		}
 		if err == ErrSubnetAllocatorFull {
 			// Current subnet exhausted, check the next one
 			continue
 		} else if err != nil {
 			utilruntime.HandleError(fmt.Errorf("Error allocating network from subnet: %v", possibleSubnet))
 			continue
-		} else {
-			return sn.String(), nil
 		}
+		allocated = append(allocated, sn.String())
+		allocatedByFamily[family] = true
+	}
+
+	if len(allocated) == 0 {
+		return nil, fmt.Errorf("error allocating network for node %s: no subnet allocators have free subnets", nodeName)
+	}
+	return allocated, nil
+}
+
+// allocatePreferredNetwork validates and attempts to allocate exactly
+// preferred, the subnet an operator pre-planned for this node (e.g. for
+// firewall or route policies), so the node gets the same subnet across
+// re-registrations.
+func (master *OsdnMaster) allocatePreferredNetwork(preferred *net.IPNet) (string, error) {
+	sa, ipnet, err := master.getSubnetAllocator(preferred.String())
+	if err != nil {
+		return "", err
 	}
-	return "", fmt.Errorf("error allocating network for node %s: %v", nodeName, err)
+	if err := sa.AllocateSpecific(ipnet); err != nil {
+		return "", &ErrPreferredSubnetTaken{Subnet: ipnet.String()}
+	}
+	return ipnet.String(), nil
+}
+
+// reserveNetwork immediately marks subnet allocated, then releases it again
+// after ttl unless a HostSubnet using it has shown up in the meantime. This
+// lets the node controller promise a subnet to a node that's still
+// bootstrapping without racing another allocation for the same subnet.
+//
+// Known race: the TTL callback's List and its subsequent Release aren't
+// atomic, so a HostSubnet for ipnet created in that window is missed, and
+// the subnet gets released and handed to a different node anyway. This is
+// bounded by ttl (the node has the whole reservation period to finish
+// registering) and is assumed rare enough in practice not to block on a
+// proper fix, which would need the code that creates ipnet's HostSubnet to
+// go through a path the TTL release can't undercut once it's started
+// (e.g. a per-subnet "claimed" flag checked under sa's mutex) rather than
+// a List race against this callback.
+func (master *OsdnMaster) reserveNetwork(subnet string, ttl time.Duration) error {
+	sa, ipnet, err := master.getSubnetAllocator(subnet)
+	if err != nil {
+		return err
+	}
+	if err := sa.AllocateSpecific(ipnet); err != nil {
+		return &ErrPreferredSubnetTaken{Subnet: ipnet.String()}
+	}
+
+	time.AfterFunc(ttl, func() {
+		hostSubnets, err := master.networkClient.NetworkV1().HostSubnets().List(metav1.ListOptions{})
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("failed to check reserved subnet %s after TTL: %v", ipnet, err))
+			return
+		}
+		for _, hs := range hostSubnets.Items {
+			if hs.Subnet == ipnet.String() {
+				return
+			}
+		}
+		if err := sa.Release(ipnet); err != nil {
+			utilruntime.HandleError(fmt.Errorf("failed to release reserved subnet %s after TTL: %v", ipnet, err))
+		}
+	})
+	return nil
 }
 
 func (master *OsdnMaster) releaseNetwork(subnet string) error {
@@ -209,7 +578,7 @@ func (master *OsdnMaster) releaseNetwork(subnet string) error {
 	if err != nil {
 		return err
 	}
-	if err = sa.releaseNetwork(ipnet); err != nil {
+	if err = sa.Release(ipnet); err != nil {
 		return err
 	}
 	return nil
@@ -220,8 +589,12 @@ func (master *OsdnMaster) getSubnetAllocator(subnet string) (*SubnetAllocator, *
 	if err != nil {
 		return nil, nil, fmt.Errorf("error parsing subnet %q: %v", subnet, err)
 	}
+	family := ipFamily(ipnet.IP)
 
 	for _, cn := range master.networkInfo.ClusterNetworks {
+		if ipFamily(cn.ClusterCIDR.IP) != family {
+			continue
+		}
 		if cn.ClusterCIDR.Contains(ipnet.IP) {
 			sa, ok := master.subnetAllocatorMap[cn]
 			if !ok || sa == nil {
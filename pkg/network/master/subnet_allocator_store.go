@@ -0,0 +1,136 @@
+package master
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kcoreclient "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	subnetAllocatorConfigMapNamespace = "openshift-sdn"
+	subnetAllocatorConfigMapName      = "subnet-allocator-state"
+)
+
+// subnetAllocatorStore persists a SubnetAllocator's internal state so that
+// master restarts don't have to rebuild allocation state by listing every
+// HostSubnet.
+type subnetAllocatorStore interface {
+	// Load returns the persisted state words and generation counter for
+	// clusterNetwork, or a nil words slice if nothing has been persisted
+	// for it yet.
+	Load(clusterNetwork string) (words []uint64, generation uint64, err error)
+	Save(clusterNetwork string, words []uint64, generation uint64) error
+}
+
+// configMapAllocatorStore stores every SubnetAllocator's state as a pair of
+// entries (state, generation), keyed by cluster network CIDR, in one shared
+// ConfigMap.
+type configMapAllocatorStore struct {
+	client kcoreclient.CoreV1Interface
+}
+
+func newConfigMapAllocatorStore(client kcoreclient.CoreV1Interface) *configMapAllocatorStore {
+	return &configMapAllocatorStore{client: client}
+}
+
+func (s *configMapAllocatorStore) Load(clusterNetwork string) ([]uint64, uint64, error) {
+	cm, err := s.client.ConfigMaps(subnetAllocatorConfigMapNamespace).Get(subnetAllocatorConfigMapName, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	encoded, ok := cm.Data[stateDataKey(clusterNetwork)]
+	if !ok {
+		return nil, 0, nil
+	}
+	generationStr, ok := cm.Data[stateGenerationKey(clusterNetwork)]
+	if !ok {
+		return nil, 0, nil
+	}
+	generation, err := strconv.ParseUint(generationStr, 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid persisted generation for %s: %v", clusterNetwork, err)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(raw)%8 != 0 {
+		return nil, 0, fmt.Errorf("invalid persisted state for %s", clusterNetwork)
+	}
+	words := make([]uint64, len(raw)/8)
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint64(raw[i*8 : i*8+8])
+	}
+	return words, generation, nil
+}
+
+// Save persists clusterNetwork's state into the shared ConfigMap, retrying
+// on conflict. A conflict is expected here: a dual-stack cluster runs one
+// SubnetAllocator per address family, each with its own mutex, and both
+// can call Save concurrently against the same ConfigMap. Retrying on
+// IsAlreadyExists too covers the narrower race where two first-ever
+// writers both Get a not-found ConfigMap and both try to Create it --
+// RetryOnConflict alone wouldn't retry that, since the loser's error is
+// AlreadyExists, not Conflict.
+func (s *configMapAllocatorStore) Save(clusterNetwork string, words []uint64, generation uint64) error {
+	raw := make([]byte, len(words)*8)
+	for i, w := range words {
+		binary.LittleEndian.PutUint64(raw[i*8:i*8+8], w)
+	}
+
+	return retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return kerrors.IsConflict(err) || kerrors.IsAlreadyExists(err)
+	}, func() error {
+		cm, err := s.client.ConfigMaps(subnetAllocatorConfigMapNamespace).Get(subnetAllocatorConfigMapName, metav1.GetOptions{})
+		if kerrors.IsNotFound(err) {
+			cm = &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      subnetAllocatorConfigMapName,
+					Namespace: subnetAllocatorConfigMapNamespace,
+				},
+			}
+		} else if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[stateDataKey(clusterNetwork)] = base64.StdEncoding.EncodeToString(raw)
+		cm.Data[stateGenerationKey(clusterNetwork)] = strconv.FormatUint(generation, 10)
+
+		if cm.ResourceVersion == "" {
+			_, err = s.client.ConfigMaps(subnetAllocatorConfigMapNamespace).Create(cm)
+		} else {
+			_, err = s.client.ConfigMaps(subnetAllocatorConfigMapNamespace).Update(cm)
+		}
+		return err
+	})
+}
+
+func stateDataKey(clusterNetwork string) string {
+	return "state." + sanitizeConfigMapKey(clusterNetwork)
+}
+
+func stateGenerationKey(clusterNetwork string) string {
+	return "generation." + sanitizeConfigMapKey(clusterNetwork)
+}
+
+// sanitizeConfigMapKey makes a CIDR safe to use as part of a ConfigMap data
+// key, which may not contain '/' or ':'.
+func sanitizeConfigMapKey(clusterNetwork string) string {
+	out := []byte(clusterNetwork)
+	for i, c := range out {
+		if c == '/' || c == ':' {
+			out[i] = '-'
+		}
+	}
+	return string(out)
+}
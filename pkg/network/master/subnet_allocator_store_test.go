@@ -0,0 +1,84 @@
+package master
+
+import (
+	"testing"
+
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	ktesting "k8s.io/client-go/testing"
+)
+
+func TestConfigMapAllocatorStoreSaveLoadRoundTrip(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store := newConfigMapAllocatorStore(client.CoreV1())
+
+	words := []uint64{0x1, 0x0102030405060708}
+	if err := store.Save("10.1.0.0/16", words, 7); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	got, generation, err := store.Load("10.1.0.0/16")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if generation != 7 {
+		t.Errorf("generation = %d, want 7", generation)
+	}
+	if len(got) != len(words) {
+		t.Fatalf("words = %v, want %v", got, words)
+	}
+	for i := range words {
+		if got[i] != words[i] {
+			t.Errorf("words[%d] = %#x, want %#x", i, got[i], words[i])
+		}
+	}
+}
+
+func TestConfigMapAllocatorStoreLoadMissing(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store := newConfigMapAllocatorStore(client.CoreV1())
+
+	words, generation, err := store.Load("10.1.0.0/16")
+	if err != nil {
+		t.Fatalf("Load on an empty store: %v", err)
+	}
+	if words != nil || generation != 0 {
+		t.Errorf("Load on an empty store = (%v, %d), want (nil, 0)", words, generation)
+	}
+}
+
+// TestConfigMapAllocatorStoreSaveRetriesOnAlreadyExists exercises the race
+// between two first-ever writers that both see a not-found ConfigMap and
+// both try to Create it: the loser gets IsAlreadyExists, which
+// retry.RetryOnConflict alone wouldn't retry. Save must retry that case
+// too rather than dropping the loser's state.
+func TestConfigMapAllocatorStoreSaveRetriesOnAlreadyExists(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store := newConfigMapAllocatorStore(client.CoreV1())
+
+	calls := 0
+	client.PrependReactor("create", "configmaps", func(action ktesting.Action) (bool, runtime.Object, error) {
+		calls++
+		if calls == 1 {
+			return true, nil, kerrors.NewAlreadyExists(
+				action.GetResource().GroupResource(), subnetAllocatorConfigMapName)
+		}
+		return false, nil, nil
+	})
+
+	if err := store.Save("10.1.0.0/16", []uint64{42}, 1); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if calls < 2 {
+		t.Fatalf("Create was called %d time(s), want at least 2 (one forced AlreadyExists, one retry)", calls)
+	}
+
+	_, generation, err := store.Load("10.1.0.0/16")
+	if err != nil {
+		t.Fatalf("Load after Save retried past AlreadyExists: %v", err)
+	}
+	if generation != 1 {
+		t.Errorf("generation = %d, want 1", generation)
+	}
+}
@@ -0,0 +1,113 @@
+package master
+
+import (
+	"net"
+	"testing"
+)
+
+// TestSubnetAddressOrdinalRoundTrip exercises the rotation subnetAddress
+// applies for network "10.1.0.0/16" with hostBits=6: ordinals should be handed out
+// as 10.1.0.0/26, 10.1.1.0/26, ..., 10.1.255.0/26, then 10.1.0.64/26, ...,
+// wrapping back through the low ordinals once every all-zero-octet subnet
+// is taken. Verifying the round trip through ordinalAt also exercises
+// rotationParams, whose rightMask computation previously failed to build.
+func TestSubnetAddressOrdinalRoundTrip(t *testing.T) {
+	_, network, err := net.ParseCIDR("10.1.0.0/16")
+	if err != nil {
+		t.Fatalf("ParseCIDR: %v", err)
+	}
+	const hostBits = 6
+	const subnetBits = 16 - hostBits // depth in the buddy tree's terms
+
+	wantFirst := []string{"10.1.0.0", "10.1.1.0", "10.1.2.0"}
+	for n, want := range wantFirst {
+		ip := subnetAddress(network, uint32(n), subnetBits)
+		if ip.String() != want {
+			t.Errorf("subnetAddress(%d) = %s, want %s", n, ip, want)
+		}
+	}
+
+	const firstWrapOrdinal = 256 // one per third-octet value: every all-zero-octet subnet is now used
+	wantAfterWrap := "10.1.0.64"
+	ip := subnetAddress(network, firstWrapOrdinal, subnetBits)
+	if ip.String() != wantAfterWrap {
+		t.Errorf("subnetAddress(%d) = %s, want %s", firstWrapOrdinal, ip, wantAfterWrap)
+	}
+
+	total := uint32(1) << subnetBits
+	for n := uint32(0); n < total; n++ {
+		ip := subnetAddress(network, n, subnetBits)
+		ipNet := &net.IPNet{IP: ip, Mask: net.CIDRMask(16+subnetBits, 32)}
+		if got := ordinalAt(network, ipNet, subnetBits); got != n {
+			t.Fatalf("ordinalAt(subnetAddress(%d)) = %d, want %d", n, got, n)
+		}
+	}
+}
+
+// TestReserveThenTTLReleaseAllowsReallocation exercises the SubnetAllocator
+// mechanics behind OsdnMaster.reserveNetwork: AllocateSpecific reserves a
+// subnet up front (as reserveNetwork does before starting its TTL timer),
+// a second reservation of the same subnet is rejected while it's held, and
+// Release (standing in for the TTL callback's fallback release once no
+// HostSubnet showed up) makes it allocatable again. The TTL timer and
+// HostSubnet List itself live in OsdnMaster, which has dependencies
+// (networkClient, networkInfo) outside this package's SubnetAllocator
+// files, so they aren't exercised here.
+func TestReserveThenTTLReleaseAllowsReallocation(t *testing.T) {
+	sa, err := newSubnetAllocator("10.1.0.0/24", 6, "", nil)
+	if err != nil {
+		t.Fatalf("newSubnetAllocator: %v", err)
+	}
+	_, reserved, err := net.ParseCIDR("10.1.0.64/26")
+	if err != nil {
+		t.Fatalf("ParseCIDR: %v", err)
+	}
+
+	if err := sa.AllocateSpecific(reserved); err != nil {
+		t.Fatalf("reserving %v: %v", reserved, err)
+	}
+	if err := sa.AllocateSpecific(reserved); err != errSubnetAlreadyAllocated {
+		t.Fatalf("re-reserving %v while held = %v, want errSubnetAlreadyAllocated", reserved, err)
+	}
+
+	// Simulate the TTL callback's fallback release, taken when no
+	// HostSubnet ever showed up for the reserved CIDR.
+	if err := sa.Release(reserved); err != nil {
+		t.Fatalf("releasing %v after TTL: %v", reserved, err)
+	}
+
+	if err := sa.AllocateSpecific(reserved); err != nil {
+		t.Fatalf("expected %v to be reallocatable after its TTL release, got %v", reserved, err)
+	}
+}
+
+// TestNewSubnetAllocatorRejectsOversizedIPv4Network confirms an IPv4
+// network wide enough to need more than maxSubnetBits of subnet ordinals
+// is rejected up front, rather than passing validation and later
+// overflowing newBuddyTree's uint32(2)<<depth sizing (which wraps to 0 for
+// depth >= 31, reached by e.g. a /0 with hostBits=1).
+func TestNewSubnetAllocatorRejectsOversizedIPv4Network(t *testing.T) {
+	if _, err := newSubnetAllocator("0.0.0.0/0", 1, "", nil); err == nil {
+		t.Fatal("expected an error for a network requiring 2^31 host subnets, got nil")
+	}
+}
+
+// TestSubnetAddressOrdinalRoundTripIPv6 repeats the round trip for an IPv6
+// cluster CIDR, since chunk0-1 generalized this arithmetic to work for
+// both address families.
+func TestSubnetAddressOrdinalRoundTripIPv6(t *testing.T) {
+	_, network, err := net.ParseCIDR("fd01:2345:6789::/48")
+	if err != nil {
+		t.Fatalf("ParseCIDR: %v", err)
+	}
+	const subnetBits = 10
+
+	total := uint32(1) << subnetBits
+	for n := uint32(0); n < total; n++ {
+		ip := subnetAddress(network, n, subnetBits)
+		ipNet := &net.IPNet{IP: ip, Mask: net.CIDRMask(48+subnetBits, 128)}
+		if got := ordinalAt(network, ipNet, subnetBits); got != n {
+			t.Fatalf("ordinalAt(subnetAddress(%d)) = %d, want %d", n, got, n)
+		}
+	}
+}
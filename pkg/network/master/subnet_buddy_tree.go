@@ -0,0 +1,164 @@
+package master
+
+// nodeState is the allocation status of one node in a SubnetAllocator's
+// buddy tree.
+type nodeState uint8
+
+const (
+	stateFree nodeState = iota
+	statePartial
+	stateUsed
+)
+
+// buddyTree is a binary buddy allocator over subnet ordinals. The root
+// (index 1) represents the whole cluster CIDR; each level down splits its
+// parent's address space into two equal halves, down to `depth` levels,
+// where a leaf represents one subnet at the smallest host-subnet size the
+// allocator is configured for. Allocating a larger subnet just grabs a node
+// higher up the tree. This lets a single ClusterNetwork serve host subnets
+// of varying sizes from the same address space, packing larger subnets
+// first (by always walking left-first) to reduce fragmentation.
+type buddyTree struct {
+	depth      uint32
+	states     []nodeState // 1-indexed complete binary tree; states[0] is unused
+	generation uint64
+}
+
+func newBuddyTree(depth uint32) *buddyTree {
+	return &buddyTree{
+		depth:  depth,
+		states: make([]nodeState, uint32(2)<<depth),
+	}
+}
+
+// findFree walks left-first from idx (at the given depth) looking for a
+// free node at targetDepth, which preserves the "use the subnets with all
+// 0s in the shared octet first" preference the original fixed-size
+// allocator had.
+func (t *buddyTree) findFree(idx, depth, targetDepth uint32) (uint32, bool) {
+	if t.states[idx] == stateUsed {
+		return 0, false
+	}
+	if depth == targetDepth {
+		if t.states[idx] == stateFree {
+			return idx, true
+		}
+		return 0, false
+	}
+	if found, ok := t.findFree(2*idx, depth+1, targetDepth); ok {
+		return found, true
+	}
+	return t.findFree(2*idx+1, depth+1, targetDepth)
+}
+
+// markUsed marks idx used and recomputes every ancestor's state.
+func (t *buddyTree) markUsed(idx uint32) {
+	t.states[idx] = stateUsed
+	t.recomputeAncestors(idx)
+}
+
+// release marks idx free, merging it back into its sibling (and that
+// sibling's sibling, and so on) on the way up to the root.
+func (t *buddyTree) release(idx uint32) {
+	t.states[idx] = stateFree
+	t.recomputeAncestors(idx)
+}
+
+func (t *buddyTree) recomputeAncestors(idx uint32) {
+	t.generation++
+	for idx > 1 {
+		idx /= 2
+		left, right := t.states[2*idx], t.states[2*idx+1]
+		switch {
+		case left == stateUsed && right == stateUsed:
+			t.states[idx] = stateUsed
+		case left == stateFree && right == stateFree:
+			t.states[idx] = stateFree
+		default:
+			t.states[idx] = statePartial
+		}
+	}
+}
+
+// indexAt returns the tree index of subnet ordinal n at depth d.
+func (t *buddyTree) indexAt(n, d uint32) uint32 {
+	return (uint32(1) << d) + n
+}
+
+// isAvailable reports whether idx is free and none of its ancestors are
+// used. (markUsed never touches the nodes beneath the one it marks, so a
+// node under a used ancestor can still read stateFree; AllocationStrategy
+// implementations that scan by ordinal, rather than doing the recursive
+// descent findFree does, need to check this explicitly.)
+func (t *buddyTree) isAvailable(idx uint32) bool {
+	if t.states[idx] != stateFree {
+		return false
+	}
+	for idx > 1 {
+		idx /= 2
+		if t.states[idx] == stateUsed {
+			return false
+		}
+	}
+	return true
+}
+
+// findFreeFrom scans ordinals at targetDepth in increasing order starting
+// at start (wrapping around once), returning the first available one. This
+// is what AllocationStrategy implementations use instead of findFree when
+// they need to resume from, or always start at, a specific ordinal.
+func (t *buddyTree) findFreeFrom(start, targetDepth uint32) (ordinal uint32, ok bool) {
+	total := uint32(1) << targetDepth
+	start %= total
+	for i := uint32(0); i < total; i++ {
+		candidate := (start + i) % total
+		if t.isAvailable(t.indexAt(candidate, targetDepth)) {
+			return candidate, true
+		}
+	}
+	return 0, false
+}
+
+// freeOrdinals returns every available ordinal at targetDepth.
+func (t *buddyTree) freeOrdinals(targetDepth uint32) []uint32 {
+	total := uint32(1) << targetDepth
+	var free []uint32
+	for n := uint32(0); n < total; n++ {
+		if t.isAvailable(t.indexAt(n, targetDepth)) {
+			free = append(free, n)
+		}
+	}
+	return free
+}
+
+// freeLeaves returns the number of leaf-granularity (the allocator's
+// smallest configured host subnet size) slots still free beneath idx.
+func (t *buddyTree) freeLeaves(idx, depth uint32) uint32 {
+	switch t.states[idx] {
+	case stateUsed:
+		return 0
+	case stateFree:
+		return uint32(1) << (t.depth - depth)
+	default:
+		return t.freeLeaves(2*idx, depth+1) + t.freeLeaves(2*idx+1, depth+1)
+	}
+}
+
+// toWords and loadWords (de)serialize the tree's states, one byte per
+// state packed 8-to-a-word, for persistence via a subnetAllocatorStore.
+func (t *buddyTree) toWords() []uint64 {
+	words := make([]uint64, (len(t.states)+7)/8)
+	for i, s := range t.states {
+		words[i/8] |= uint64(s) << uint((i%8)*8)
+	}
+	return words
+}
+
+func (t *buddyTree) loadWords(words []uint64) {
+	for i := range t.states {
+		wi, shift := i/8, uint((i%8)*8)
+		if wi < len(words) {
+			t.states[i] = nodeState((words[wi] >> shift) & 0xFF)
+		}
+	}
+}
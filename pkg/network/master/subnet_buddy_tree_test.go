@@ -0,0 +1,108 @@
+package master
+
+import "testing"
+
+// TestBuddyTreeSplitAndMerge exercises allocating both halves of a subtree
+// and confirms the parent only reports free again once both children do,
+// and reports the tree's free leaf count correctly along the way.
+func TestBuddyTreeSplitAndMerge(t *testing.T) {
+	const depth = 2 // 4 leaves: indices 4,5,6,7
+	tree := newBuddyTree(depth)
+
+	if got, want := tree.freeLeaves(1, 0), uint32(4); got != want {
+		t.Fatalf("freeLeaves before any allocation = %d, want %d", got, want)
+	}
+
+	left, ok := tree.findFree(1, 0, depth)
+	if !ok {
+		t.Fatal("findFree: expected a free leaf")
+	}
+	tree.markUsed(left)
+	if tree.states[1] != statePartial {
+		t.Fatalf("root state after one leaf used = %v, want statePartial", tree.states[1])
+	}
+	if got, want := tree.freeLeaves(1, 0), uint32(3); got != want {
+		t.Fatalf("freeLeaves after one leaf used = %d, want %d", got, want)
+	}
+
+	// Allocating left's sibling should make their shared parent stateUsed,
+	// but the root stays statePartial since the other subtree is untouched.
+	sibling := left ^ 1
+	tree.markUsed(sibling)
+	parent := left / 2
+	if tree.states[parent] != stateUsed {
+		t.Fatalf("parent state after both children used = %v, want stateUsed", tree.states[parent])
+	}
+	if tree.states[1] != statePartial {
+		t.Fatalf("root state after one subtree fully used = %v, want statePartial", tree.states[1])
+	}
+
+	tree.release(left)
+	if tree.states[parent] != statePartial {
+		t.Fatalf("parent state after releasing one child = %v, want statePartial", tree.states[parent])
+	}
+
+	tree.release(sibling)
+	if tree.states[parent] != stateFree {
+		t.Fatalf("parent state after releasing both children = %v, want stateFree", tree.states[parent])
+	}
+	if tree.states[1] != stateFree {
+		t.Fatalf("root state after releasing both children = %v, want stateFree", tree.states[1])
+	}
+	if got, want := tree.freeLeaves(1, 0), uint32(4); got != want {
+		t.Fatalf("freeLeaves after releasing everything = %d, want %d", got, want)
+	}
+}
+
+// TestBuddyTreeAllocatingWiderSubnetBlocksNarrowerDescendants confirms that
+// marking a higher (wider) node used makes every leaf beneath it
+// unavailable, and that it is reported back to freeLeaves/isAvailable
+// correctly even though their own per-leaf state was never touched.
+func TestBuddyTreeAllocatingWiderSubnetBlocksNarrowerDescendants(t *testing.T) {
+	const depth = 2
+	tree := newBuddyTree(depth)
+
+	// Mark the left half of the tree (depth 1, one level above the leaves)
+	// used in one shot, as AllocateWithHostBits does for a wider subnet.
+	tree.markUsed(2)
+
+	if got, want := tree.freeLeaves(1, 0), uint32(2); got != want {
+		t.Fatalf("freeLeaves with left half used = %d, want %d", got, want)
+	}
+	for _, leaf := range []uint32{4, 5} {
+		if tree.isAvailable(leaf) {
+			t.Errorf("leaf %d under a used ancestor reported available", leaf)
+		}
+	}
+	for _, leaf := range []uint32{6, 7} {
+		if !tree.isAvailable(leaf) {
+			t.Errorf("leaf %d under the untouched subtree reported unavailable", leaf)
+		}
+	}
+
+	if free := tree.freeOrdinals(depth); len(free) != 2 || free[0] != 2 || free[1] != 3 {
+		t.Fatalf("freeOrdinals(%d) = %v, want [2 3]", depth, free)
+	}
+}
+
+// TestBuddyTreeToWordsLoadWordsRoundTrip confirms every node state survives
+// a toWords/loadWords cycle. The generation counter is not part of the
+// words and is not checked here.
+func TestBuddyTreeToWordsLoadWordsRoundTrip(t *testing.T) {
+	const depth = 3
+	tree := newBuddyTree(depth)
+	tree.markUsed(tree.indexAt(2, depth))
+	tree.markUsed(tree.indexAt(5, depth))
+	tree.release(tree.indexAt(2, depth))
+
+	words := tree.toWords()
+
+	loaded := newBuddyTree(depth)
+	loaded.loadWords(words)
+
+	for i := range tree.states {
+		if loaded.states[i] != tree.states[i] {
+			t.Fatalf("state[%d] after round trip = %v, want %v", i, loaded.states[i], tree.states[i])
+		}
+	}
+}